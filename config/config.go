@@ -11,75 +11,108 @@ import (
 	"github.com/jcmturner/mfaserver/vault"
 	"github.com/jcmturner/restclient"
 	"github.com/mavricknz/ldap"
-	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
-	"os"
-	"strconv"
-	"strings"
+	"sync"
 )
 
 var validLogLevels = []string{"ERROR", "WARNING", "INFO", "DEBUG"}
 
 type Config struct {
-	Vault     VaultConf `json:"Vault"`
-	MFAServer MFAServer `json:"MFAServer"`
-	LDAP      LDAPConf  `json:"LDAP"`
+	Vault     VaultConf `json:"Vault" yaml:"Vault"`
+	MFAServer MFAServer `json:"MFAServer" yaml:"MFAServer"`
+	LDAP      LDAPConf  `json:"LDAP" yaml:"LDAP"`
+
+	// mu guards the subsystem state above against concurrent mutation by
+	// Reload/reinitSubsystem (driven by ServeControl's per-connection
+	// goroutines and the Vault token lifetime watcher) racing with one
+	// another or with anything reading that state while the server runs.
+	mu sync.RWMutex
 }
 
 type VaultConf struct {
-	VaultReSTClientConfig *restclient.Config `json:"VaultConnection"`
-	AppIDRead             *string            `json:"AppIDRead"`
-	AppIDWrite            *string            `json:"AppIDWrite"`
-	UserIDFile            *string            `json:"UserIDFile"`
-	UserID                *string            `json:"UserID"`
-	MFASecretsPath        *string            `json:"MFASecretsPath"`
+	VaultReSTClientConfig *restclient.Config  `json:"VaultConnection" yaml:"VaultConnection"`
+	AuthMethod            *string             `json:"AuthMethod" yaml:"AuthMethod"`
+	AppIDRead             *string             `json:"AppIDRead" yaml:"AppIDRead"`
+	AppIDWrite            *string             `json:"AppIDWrite" yaml:"AppIDWrite"`
+	UserIDFile            *string             `json:"UserIDFile" yaml:"UserIDFile"`
+	UserID                *string             `json:"UserID" yaml:"UserID"`
+	AppRole               *AppRoleAuthConf    `json:"AppRole" yaml:"AppRole"`
+	Kubernetes            *KubernetesAuthConf `json:"Kubernetes" yaml:"Kubernetes"`
+	Token                 *string             `json:"Token" yaml:"Token"`
+	MFASecretsPath        *string             `json:"MFASecretsPath" yaml:"MFASecretsPath"`
 	VaultConfig           *vaultAPI.Config
 	VaultClient           *vaultAPI.Client
 	VaultLogin            *vault.Login
+	watchStop             chan struct{}
 }
 
 type LDAPConf struct {
-	EndPoint            *string `json:"EndPoint"`
-	TrustCACert         *string `json:"TrustCACert"`
-	UserDN              *string `json:"UserDN"`
-	AdminGroupDN        *string `json:"AdminGroupDN"`
-	AdminMembershipAttr *string `json:"AdminGroupMembershipAttribute"`
-	AdminMemberUserDN   *string `json:"AdminGroupMemberDNFormat"`
+	Defaults            *LDAPServer   `json:"Defaults" yaml:"Defaults"`
+	Servers             []*LDAPServer `json:"Servers" yaml:"Servers"`
+	UserDN              *string       `json:"UserDN" yaml:"UserDN"`
+	AdminGroupDN        *string       `json:"AdminGroupDN" yaml:"AdminGroupDN"`
+	AdminMembershipAttr *string       `json:"AdminGroupMembershipAttribute" yaml:"AdminGroupMembershipAttribute"`
+	AdminMemberUserDN   *string       `json:"AdminGroupMemberDNFormat" yaml:"AdminGroupMemberDNFormat"`
 	LDAPConnection      *ldap.LDAPConnection
+	ActiveServer        *LDAPServer
 }
 
+// LDAPServer describes a single LDAP server to try when establishing a
+// connection. TLSMode is one of "no", "starttls" or "ldaps". Any field left
+// nil is filled in from LDAPConf.Defaults by withLDAPServerDefaults.
+type LDAPServer struct {
+	Host          *string `json:"Host" yaml:"Host"`
+	Port          *uint16 `json:"Port" yaml:"Port"`
+	TLSMode       *string `json:"TLSMode" yaml:"TLSMode"`
+	TLSSkipVerify *bool   `json:"TLSSkipVerify" yaml:"TLSSkipVerify"`
+	TrustCACert   *string `json:"TrustCACert" yaml:"TrustCACert"`
+}
+
+const (
+	ldapTLSModeNo       = "no"
+	ldapTLSModeStartTLS = "starttls"
+	ldapTLSModeLDAPS    = "ldaps"
+)
+
 type UserIdFile struct {
-	UserID string `json:"UserID"`
+	UserID string `json:"UserID" yaml:"UserID"`
 }
 
 type MFAServer struct {
-	ListenerSocket *string `json:"ListenerSocket"`
-	TLS            TLS     `json:"TLS"`
-	LogFilePath    *string `json:"LogFile"`
-	LogLevel       *string `json:"LogLevel"`
-	Loggers        *Loggers
+	ListenerSocket *string            `json:"ListenerSocket" yaml:"ListenerSocket"`
+	TLS            TLS                `json:"TLS" yaml:"TLS"`
+	LogFilePath    *string            `json:"LogFile" yaml:"LogFile"`
+	LogLevel       *string            `json:"LogLevel" yaml:"LogLevel"`
+	ControlSocket  *ControlSocketConf `json:"ControlSocket" yaml:"ControlSocket"`
+	LogSinks       *LogSinksConf      `json:"LogSinks" yaml:"LogSinks"`
+	Loggers        Loggers
 }
 
-type TLS struct {
-	Enabled         bool    `json:"Enabled"`
-	CertificateFile *string `json:"CertificateFile"`
-	KeyFile         *string `json:"KeyFile"`
+// ControlSocketConf configures the UNIX domain socket used to send this
+// server runtime control messages. Mode is an octal permission string, e.g.
+// "0660".
+type ControlSocketConf struct {
+	Path  *string `json:"Path" yaml:"Path"`
+	Group *string `json:"Group" yaml:"Group"`
+	Mode  *string `json:"Mode" yaml:"Mode"`
 }
 
-type Loggers struct {
-	Debug   *log.Logger
-	Info    *log.Logger
-	Warning *log.Logger
-	Error   *log.Logger
+type TLS struct {
+	Enabled           bool     `json:"Enabled" yaml:"Enabled"`
+	CertificateFile   *string  `json:"CertificateFile" yaml:"CertificateFile"`
+	KeyFile           *string  `json:"KeyFile" yaml:"KeyFile"`
+	ClientCAFile      *string  `json:"ClientCAFile" yaml:"ClientCAFile"`
+	RequireClientCert bool     `json:"RequireClientCert" yaml:"RequireClientCert"`
+	AllowedClientCNs  []string `json:"AllowedClientCNs" yaml:"AllowedClientCNs"`
+	AllowedClientOUs  []string `json:"AllowedClientOUs" yaml:"AllowedClientOUs"`
+	Config            *tls.Config
 }
 
 func NewConfig() *Config {
 	defSecPath := "secret/mfa"
 	defSocket := "0.0.0.0:8443"
-	dl := log.New(ioutil.Discard, "", os.O_APPEND)
 	return &Config{
 		Vault: VaultConf{
 			VaultReSTClientConfig: restclient.NewConfig(),
@@ -88,46 +121,11 @@ func NewConfig() *Config {
 		},
 		MFAServer: MFAServer{
 			ListenerSocket: &defSocket,
-			Loggers: &Loggers{
-				Debug:   dl,
-				Info:    dl,
-				Warning: dl,
-				Error:   dl,
-			},
+			Loggers:        discardLoggers(),
 		},
 	}
 }
 
-func loggerSetUp(c *Config) error {
-	var logfile io.Writer
-	if c.MFAServer.LogFilePath != nil {
-		var err error
-		logfile, err = os.OpenFile(*c.MFAServer.LogFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
-		if err != nil {
-			return err
-		}
-	} else {
-		logfile = os.Stdout
-	}
-	c.MFAServer.Loggers.Error = log.New(logfile, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	if c.MFAServer.LogLevel != nil && isValidLogLevel(*c.MFAServer.LogLevel) {
-		switch *c.MFAServer.LogLevel {
-		case "DEBUG":
-			c.MFAServer.Loggers.Debug = log.New(logfile, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
-			c.MFAServer.Loggers.Info = log.New(logfile, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-			c.MFAServer.Loggers.Warning = log.New(logfile, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-		case "INFO":
-			c.MFAServer.Loggers.Info = log.New(logfile, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-			c.MFAServer.Loggers.Warning = log.New(logfile, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-		case "WARNING":
-			c.MFAServer.Loggers.Warning = log.New(logfile, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-		}
-		return nil
-	} else {
-		return errors.New(fmt.Sprintf("An invalid log level was provided. Accepted values are %v", validLogLevels))
-	}
-}
-
 func Load(cfgPath string) (*Config, error) {
 	j, err := ioutil.ReadFile(cfgPath)
 	if err != nil {
@@ -135,7 +133,7 @@ func Load(cfgPath string) (*Config, error) {
 	}
 
 	c := NewConfig()
-	err = json.Unmarshal(j, c)
+	err = unmarshalConfig(cfgPath, j, c)
 	if err != nil {
 		return nil, errors.New("Configuration file could not be parsed: " + err.Error())
 	}
@@ -147,13 +145,15 @@ func Load(cfgPath string) (*Config, error) {
 	if c.Vault.VaultReSTClientConfig.TrustCACert != nil {
 		c.WithVaultCAFilePath(*c.Vault.VaultReSTClientConfig.TrustCACert)
 	}
-	if c.Vault.UserID == nil {
-		if c.Vault.UserIDFile == nil {
-			return nil, errors.New("Configuration file does not define a UserId or UserIdFile to use to access Vault")
-		} else {
-			_, err := c.WithVaultUserIdFile(*c.Vault.UserIDFile)
-			if err != nil {
-				return nil, errors.New("Configuration issue with processing the UserIDFile: " + err.Error())
+	if c.Vault.authMethod() == vaultAuthAppID {
+		if c.Vault.UserID == nil {
+			if c.Vault.UserIDFile == nil {
+				return nil, errors.New("Configuration file does not define a UserId or UserIdFile to use to access Vault")
+			} else {
+				_, err := c.WithVaultUserIdFile(*c.Vault.UserIDFile)
+				if err != nil {
+					return nil, errors.New("Configuration issue with processing the UserIDFile: " + err.Error())
+				}
 			}
 		}
 	}
@@ -167,6 +167,10 @@ func Load(cfgPath string) (*Config, error) {
 	if err != nil {
 		return nil, errors.New("Error configuring LDAP connection: " + err.Error())
 	}
+	err = c.authenticateVault()
+	if err != nil {
+		return nil, errors.New("Error authenticating to Vault: " + err.Error())
+	}
 	return c, nil
 }
 
@@ -266,20 +270,86 @@ func (c *Config) WithMFATLS(certPath, keyPath string) (*Config, error) {
 	if err := isValidPEMFile(keyPath); err != nil {
 		return c, errors.New("MFA Server TLS key not valid: " + err.Error())
 	}
-	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
-		cert, _ := ioutil.ReadFile(certPath)
-		key, _ := ioutil.ReadFile(keyPath)
-		fmt.Printf("Cert: \n %s\n Key: \n %s", cert, key)
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		certPEM, _ := ioutil.ReadFile(certPath)
+		keyPEM, _ := ioutil.ReadFile(keyPath)
+		fmt.Printf("Cert: \n %s\n Key: \n %s", certPEM, keyPEM)
 		return c, errors.New("Key pair provided not valid: " + err.Error())
 	}
-	c.MFAServer.TLS = TLS{
-		Enabled:         true,
-		CertificateFile: &certPath,
-		KeyFile:         &keyPath,
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := c.MFAServer.TLS
+	t.Enabled = true
+	t.CertificateFile = &certPath
+	t.KeyFile = &keyPath
+
+	tlsConfig := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
 	}
+
+	if t.ClientCAFile != nil {
+		pemData, err := ioutil.ReadFile(*t.ClientCAFile)
+		if err != nil {
+			return c, errors.New("Could not read MFA Server TLS ClientCAFile: " + err.Error())
+		}
+		clientCAs := x509.NewCertPool()
+		if ok := clientCAs.AppendCertsFromPEM(pemData); !ok {
+			return c, errors.New("Couldn't load PEM data for MFA Server TLS ClientCAFile")
+		}
+		tlsConfig.ClientCAs = clientCAs
+	}
+
+	if t.RequireClientCert {
+		if tlsConfig.ClientCAs == nil {
+			return c, errors.New("RequireClientCert is set but no ClientCAFile was provided")
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.VerifyPeerCertificate = verifyClientAllowList(t.AllowedClientCNs, t.AllowedClientOUs)
+	}
+
+	tlsConfig.BuildNameToCertificate()
+
+	t.Config = tlsConfig
+	c.MFAServer.TLS = t
 	return c, nil
 }
 
+// verifyClientAllowList builds a VerifyPeerCertificate hook that rejects a
+// client certificate whose Subject CN and OU are both absent from the given
+// allowlists. Only the client's own leaf certificate (rawCerts[0]) is
+// checked; intermediate CA certificates in the presented chain must not be
+// able to satisfy the allowlist on the client's behalf. When both allowlists
+// are empty every client is accepted; when only one is empty, that attribute
+// cannot match and the client must match the other list.
+func verifyClientAllowList(cns, ous []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(cns) == 0 && len(ous) == 0 {
+			return nil
+		}
+		if len(rawCerts) == 0 {
+			return errors.New("Client presented no certificate")
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return errors.New("Could not parse client leaf certificate: " + err.Error())
+		}
+		if len(cns) > 0 && stringInSlice(leaf.Subject.CommonName, cns) {
+			return nil
+		}
+		for _, ou := range leaf.Subject.OrganizationalUnit {
+			if len(ous) > 0 && stringInSlice(ou, ous) {
+				return nil
+			}
+		}
+		return errors.New("Client certificate Subject CN/OU is not in the allowed list")
+	}
+}
+
 func (c *Config) WithLogLevel(l string) (*Config, error) {
 	if isValidLogLevel(l) {
 		c.MFAServer.LogLevel = &l
@@ -317,9 +387,15 @@ func stringInSlice(a string, list []string) bool {
 	return false
 }
 
-func (c *Config) WithLDAPConnection(e, ca, dn string) {
-	c.LDAP.EndPoint = &e
-	c.LDAP.TrustCACert = &ca
+func (c *Config) WithLDAPConnection(host string, port uint16, tlsMode, ca, dn string) {
+	c.LDAP.Servers = []*LDAPServer{
+		{
+			Host:        &host,
+			Port:        &port,
+			TLSMode:     &tlsMode,
+			TrustCACert: &ca,
+		},
+	}
 	c.LDAP.UserDN = &dn
 	c.createLDAPConnection()
 }
@@ -331,40 +407,139 @@ func (c *Config) WithLDAPAdminSettings(gdn, attr, m string) {
 	c.LDAP.AdminMemberUserDN = &m
 }
 
-func (c *Config) createLDAPConnection() error {
-	var port uint64
-	s := *c.LDAP.EndPoint
-	if strings.HasPrefix(*c.LDAP.EndPoint, "ldaps://") {
-		s = s[len("ldaps://"):]
-		if i := strings.LastIndex(s, ":"); i != -1 {
-			port, _ = strconv.ParseUint(s[i+1:], 10, 16)
-			s = s[0:i]
-		} else {
-			port = 636
+// withLDAPServerDefaults fills in any field left blank on s with the
+// corresponding value from LDAP.Defaults.
+func (c *Config) withLDAPServerDefaults(s *LDAPServer) *LDAPServer {
+	d := c.LDAP.Defaults
+	if d == nil {
+		return s
+	}
+	if s.Host == nil {
+		s.Host = d.Host
+	}
+	if s.Port == nil {
+		s.Port = d.Port
+	}
+	if s.TLSMode == nil {
+		s.TLSMode = d.TLSMode
+	}
+	if s.TLSSkipVerify == nil {
+		s.TLSSkipVerify = d.TLSSkipVerify
+	}
+	if s.TrustCACert == nil {
+		s.TrustCACert = d.TrustCACert
+	}
+	return s
+}
+
+// ldapConnect dials a single LDAP server according to its TLS mode and
+// returns a connection that has not yet been health checked.
+func ldapConnect(s *LDAPServer) (*ldap.LDAPConnection, error) {
+	if s.Host == nil {
+		return nil, errors.New("LDAP server entry has no Host defined")
+	}
+	host := *s.Host
+	mode := ldapTLSModeNo
+	if s.TLSMode != nil {
+		mode = *s.TLSMode
+	}
+	switch mode {
+	case ldapTLSModeLDAPS:
+		port := uint16(636)
+		if s.Port != nil {
+			port = *s.Port
+		}
+		tlsConfig, err := ldapTLSConfig(s)
+		if err != nil {
+			return nil, err
+		}
+		return ldap.NewLDAPSSLConnection(host, port, tlsConfig), nil
+	case ldapTLSModeStartTLS:
+		port := uint16(389)
+		if s.Port != nil {
+			port = *s.Port
+		}
+		tlsConfig, err := ldapTLSConfig(s)
+		if err != nil {
+			return nil, err
+		}
+		return ldap.NewLDAPTLSConnection(host, port, tlsConfig), nil
+	case ldapTLSModeNo:
+		port := uint16(389)
+		if s.Port != nil {
+			port = *s.Port
 		}
+		return ldap.NewLDAPConnection(host, port), nil
+	default:
+		return nil, errors.New("Invalid TLSMode in LDAP server config: " + mode)
+	}
+}
 
-		tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
-		pemData, err := ioutil.ReadFile(*c.LDAP.TrustCACert)
+// ldapTLSConfig builds the tls.Config shared by the ldaps (implicit TLS) and
+// starttls (plaintext connect then STARTTLS) modes.
+func ldapTLSConfig(s *LDAPServer) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: s.TLSSkipVerify != nil && *s.TLSSkipVerify}
+	if s.TrustCACert != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		pemData, err := ioutil.ReadFile(*s.TrustCACert)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		ok := tlsConfig.RootCAs.AppendCertsFromPEM(pemData)
-		if !ok {
-			return errors.New("Couldn't load PEM data for LDAP connection")
+		if ok := tlsConfig.RootCAs.AppendCertsFromPEM(pemData); !ok {
+			return nil, errors.New("Couldn't load PEM data for LDAP connection")
 		}
+	}
+	return tlsConfig, nil
+}
 
-		c.LDAP.LDAPConnection = ldap.NewLDAPTLSConnection(s, uint16(port), tlsConfig)
-	} else if strings.HasPrefix(*c.LDAP.EndPoint, "ldap://") {
-		s = s[len("ldap://"):]
-		if i := strings.LastIndex(s, ":"); i != -1 {
-			port, _ = strconv.ParseUint(s[i+1:], 10, 16)
-			s = s[0:i]
-		} else {
-			port = 389
+// ldapHealthCheck opens conn and performs an anonymous bind plus a cheap
+// base-level search to confirm the server is reachable and usable. conn is
+// left open on success, since the caller stores it as the active
+// connection; it is only closed if the probe itself fails.
+func ldapHealthCheck(conn *ldap.LDAPConnection) (err error) {
+	if err = conn.Connect(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
 		}
-		c.LDAP.LDAPConnection = ldap.NewLDAPConnection(s, uint16(port))
-	} else {
-		return errors.New("Invalid protocol in LDAP endpoint: " + *c.LDAP.EndPoint)
+	}()
+	if err = conn.Bind("", ""); err != nil {
+		return err
+	}
+	searchReq := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", []string{"1.1"}, nil)
+	if _, err = conn.Search(searchReq); err != nil {
+		return err
 	}
 	return nil
 }
+
+// createLDAPConnection tries each configured LDAP server in order, applying
+// LDAP.Defaults to fill in any blank fields, and uses the first one that
+// passes its health check. It is also used to fail over away from the
+// currently active server when it stops responding.
+func (c *Config) createLDAPConnection() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.LDAP.Servers) == 0 {
+		return errors.New("No LDAP servers configured")
+	}
+	var lastErr error
+	for _, srv := range c.LDAP.Servers {
+		srv = c.withLDAPServerDefaults(srv)
+		conn, err := ldapConnect(srv)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := ldapHealthCheck(conn); err != nil {
+			lastErr = err
+			continue
+		}
+		c.LDAP.ActiveServer = srv
+		c.LDAP.LDAPConnection = conn
+		return nil
+	}
+	return errors.New("No LDAP server could be reached: " + lastErr.Error())
+}
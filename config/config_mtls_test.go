@@ -0,0 +1,55 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+)
+
+func selfSignedCertDER(t *testing.T, cn string, ou string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: []string{ou}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	return der
+}
+
+func TestVerifyClientAllowListEmptyAllowlist(t *testing.T) {
+	der := selfSignedCertDER(t, "alice", "engineering")
+	if err := verifyClientAllowList(nil, nil)([][]byte{der}, nil); err != nil {
+		t.Fatalf("expected empty allowlists to permit any client, got: %v", err)
+	}
+}
+
+func TestVerifyClientAllowListNoCertPresented(t *testing.T) {
+	if err := verifyClientAllowList([]string{"alice"}, nil)(nil, nil); err == nil {
+		t.Fatal("expected an error when no client certificate is presented")
+	}
+}
+
+func TestVerifyClientAllowListCNOrOUMatch(t *testing.T) {
+	der := selfSignedCertDER(t, "bob", "ops")
+
+	if err := verifyClientAllowList([]string{"bob"}, nil)([][]byte{der}, nil); err != nil {
+		t.Fatalf("expected CN match to be allowed, got: %v", err)
+	}
+	if err := verifyClientAllowList(nil, []string{"ops"})([][]byte{der}, nil); err != nil {
+		t.Fatalf("expected OU match to be allowed, got: %v", err)
+	}
+	if err := verifyClientAllowList([]string{"someone-else"}, []string{"someone-else"})([][]byte{der}, nil); err == nil {
+		t.Fatal("expected a CN/OU mismatch to be rejected")
+	}
+}
@@ -0,0 +1,46 @@
+package config
+
+import "testing"
+
+func strPtr(s string) *string { return &s }
+
+func TestLdapConnectTLSMode(t *testing.T) {
+	host := "ldap.example.com"
+
+	cases := []struct {
+		name       string
+		mode       *string
+		wantIsSSL  bool
+		wantIsTLS  bool
+		wantTLSCfg bool
+	}{
+		{"no mode defaults to plaintext", nil, false, false, false},
+		{"no", strPtr(ldapTLSModeNo), false, false, false},
+		{"ldaps uses implicit TLS", strPtr(ldapTLSModeLDAPS), true, false, true},
+		{"starttls uses plaintext connect then StartTLS", strPtr(ldapTLSModeStartTLS), false, true, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conn, err := ldapConnect(&LDAPServer{Host: &host, TLSMode: c.mode})
+			if err != nil {
+				t.Fatalf("ldapConnect() error = %v", err)
+			}
+			if conn.IsSSL != c.wantIsSSL {
+				t.Errorf("IsSSL = %v, want %v", conn.IsSSL, c.wantIsSSL)
+			}
+			if conn.IsTLS != c.wantIsTLS {
+				t.Errorf("IsTLS = %v, want %v", conn.IsTLS, c.wantIsTLS)
+			}
+			if (conn.TlsConfig != nil) != c.wantTLSCfg {
+				t.Errorf("TlsConfig set = %v, want %v", conn.TlsConfig != nil, c.wantTLSCfg)
+			}
+		})
+	}
+}
+
+func TestLdapConnectInvalidTLSMode(t *testing.T) {
+	host := "ldap.example.com"
+	if _, err := ldapConnect(&LDAPServer{Host: &host, TLSMode: strPtr("bogus")}); err == nil {
+		t.Fatal("expected an error for an invalid TLSMode")
+	}
+}
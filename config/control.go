@@ -0,0 +1,182 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// Reload parses the config file at path (JSON or YAML, chosen by its
+// extension as in Load) into a fresh Config, running
+// all the same WithX validators that Load does, and only swaps it into the
+// live c if the whole new config validates. On any failure the previously
+// running configuration (loggers, LDAP connection, Vault client, and so on)
+// is left untouched. The previous config's Vault token lifetime watcher is
+// stopped, and its LDAP connection closed, before the swap: the watcher
+// would otherwise re-authenticate against, and clobber, the newly loaded
+// Vault client once it is live, and the LDAP connection would otherwise
+// leak (ldapHealthCheck deliberately leaves it open for reuse). The swap
+// itself is done under c.mu so it cannot race with ServeControl's
+// per-connection goroutines or the Vault watcher reading or mutating c's
+// fields concurrently.
+func (c *Config) Reload(path string) error {
+	newC, err := Load(path)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopVaultWatch()
+	if c.LDAP.LDAPConnection != nil {
+		c.LDAP.LDAPConnection.Close()
+	}
+	// Copy field-by-field rather than *c = *newC so c.mu (held above) isn't
+	// itself overwritten by newC's zero-value mutex.
+	c.Vault = newC.Vault
+	c.MFAServer = newC.MFAServer
+	c.LDAP = newC.LDAP
+	return nil
+}
+
+// ServeControl listens on the configured control socket for single
+// character control messages: "Q" to quit gracefully (invoking cancel),
+// "R" to reload the config from cfgPath, and "U[!]<selector>" to force
+// re-initialization of a named subsystem ("vault", "ldap", "tls" or "*").
+// It blocks until ctx is cancelled or the listener fails to open.
+func (c *Config) ServeControl(ctx context.Context, cfgPath string, cancel context.CancelFunc) error {
+	conf := c.MFAServer.ControlSocket
+	if conf == nil || conf.Path == nil {
+		return errors.New("No control socket path configured")
+	}
+	path := *conf.Path
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return errors.New("Could not open control socket: " + err.Error())
+	}
+	if err := applyControlSocketPerms(path, conf); err != nil {
+		l.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	c.MFAServer.Loggers.Info("Control socket listening", Fields{"path": path})
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+				c.MFAServer.Loggers.Error("Control socket accept error", Fields{"error": err.Error()})
+				continue
+			}
+		}
+		go c.handleControlConn(conn, cfgPath, cancel)
+	}
+}
+
+func applyControlSocketPerms(path string, conf *ControlSocketConf) error {
+	if conf.Mode != nil {
+		m, err := strconv.ParseUint(*conf.Mode, 8, 32)
+		if err != nil {
+			return errors.New("Invalid control socket mode: " + err.Error())
+		}
+		if err := os.Chmod(path, os.FileMode(m)); err != nil {
+			return errors.New("Could not chmod control socket: " + err.Error())
+		}
+	}
+	if conf.Group != nil {
+		g, err := user.LookupGroup(*conf.Group)
+		if err != nil {
+			return errors.New("Could not look up control socket group: " + err.Error())
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return errors.New("Invalid gid for control socket group: " + err.Error())
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return errors.New("Could not chown control socket: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (c *Config) handleControlConn(conn net.Conn, cfgPath string, cancel context.CancelFunc) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		return
+	}
+	msg := strings.TrimSpace(scanner.Text())
+	if msg == "" {
+		return
+	}
+	switch msg[0] {
+	case 'Q':
+		fmt.Fprintln(conn, "OK quitting")
+		cancel()
+	case 'R':
+		if err := c.Reload(cfgPath); err != nil {
+			c.MFAServer.Loggers.Error("Config reload failed", Fields{"error": err.Error()})
+			fmt.Fprintln(conn, "ERROR "+err.Error())
+			return
+		}
+		fmt.Fprintln(conn, "OK reloaded")
+	case 'U':
+		selector := strings.TrimPrefix(msg[1:], "!")
+		force := strings.HasPrefix(msg[1:], "!")
+		if err := c.reinitSubsystem(selector, force); err != nil {
+			c.MFAServer.Loggers.Error("Subsystem re-init failed", Fields{"selector": selector, "error": err.Error()})
+			fmt.Fprintln(conn, "ERROR "+err.Error())
+			return
+		}
+		fmt.Fprintln(conn, "OK reinitialised "+selector)
+	default:
+		fmt.Fprintln(conn, "ERROR unrecognised control message")
+	}
+}
+
+// reinitSubsystem forces re-initialization of a single named subsystem, or
+// all of them when selector is "*". force is currently only meaningful for
+// subsystems that otherwise skip re-init when they are disabled.
+func (c *Config) reinitSubsystem(selector string, force bool) error {
+	switch selector {
+	case "ldap":
+		return c.createLDAPConnection()
+	case "tls":
+		if !c.MFAServer.TLS.Enabled && !force {
+			return nil
+		}
+		if c.MFAServer.TLS.CertificateFile == nil || c.MFAServer.TLS.KeyFile == nil {
+			return errors.New("TLS re-init requested but no CertificateFile/KeyFile is configured")
+		}
+		_, err := c.WithMFATLS(*c.MFAServer.TLS.CertificateFile, *c.MFAServer.TLS.KeyFile)
+		return err
+	case "vault":
+		return c.reinitVault()
+	case "*":
+		for _, s := range []string{"ldap", "tls", "vault"} {
+			if err := c.reinitSubsystem(s, force); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return errors.New("Unknown subsystem selector: " + selector)
+	}
+}
+
+func (c *Config) reinitVault() error {
+	return c.authenticateVault()
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// unmarshalConfig picks a parser based on cfgPath's extension (.json/.jsn
+// for JSON, .yaml/.yml for YAML), interpolates ${VAR} environment variable
+// references into j, and unmarshals the result into c. This makes the
+// module usable in Kubernetes/Compose deployments where YAML+env is the
+// idiomatic packaging, while plain JSON configs still parse as before
+// (apart from the same ${VAR} interpolation).
+func unmarshalConfig(cfgPath string, j []byte, c *Config) error {
+	j = interpolateEnv(j)
+	switch strings.ToLower(filepath.Ext(cfgPath)) {
+	case ".json", ".jsn":
+		return json.Unmarshal(j, c)
+	case ".yaml", ".yml":
+		return unmarshalYAML(j, c)
+	default:
+		return errors.New("Unrecognised configuration file extension: " + filepath.Ext(cfgPath))
+	}
+}
+
+// interpolateEnv replaces ${VAR} references in j with the value of the VAR
+// environment variable, leaving references to unset variables untouched.
+// ${VAR} is expected to sit inside an existing quoted JSON/YAML string
+// value, so the substituted value is JSON-string-escaped before splicing in:
+// otherwise a value containing a `"`, a backslash or a newline (plausible
+// for a credential such as a bind password) would corrupt, or inject
+// unintended keys into, the surrounding document. YAML double-quoted
+// scalars escape `"`/`\`/control characters the same way JSON does, so the
+// same escaping is safe for both supported formats.
+func interpolateEnv(j []byte) []byte {
+	return envVarPattern.ReplaceAllFunc(j, func(match []byte) []byte {
+		name := envVarPattern.FindSubmatch(match)[1]
+		if v, ok := os.LookupEnv(string(name)); ok {
+			return escapeForQuotedString(v)
+		}
+		return match
+	})
+}
+
+// escapeForQuotedString JSON-escapes s and strips the surrounding quotes
+// json.Marshal adds, leaving bytes safe to splice inside an existing
+// double-quoted JSON or YAML string.
+func escapeForQuotedString(s string) []byte {
+	b, _ := json.Marshal(s)
+	return b[1 : len(b)-1]
+}
+
+// unmarshalYAML decodes j as YAML, resolving any "!include path" tags to
+// the contents of the named file before decoding into c. Included files are
+// expected to hold secret fragments and are rejected if their permissions
+// are more permissive than owner-only.
+func unmarshalYAML(j []byte, c *Config) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(j, &root); err != nil {
+		return err
+	}
+	if err := resolveYAMLIncludes(&root); err != nil {
+		return err
+	}
+	return root.Decode(c)
+}
+
+func resolveYAMLIncludes(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!include" {
+		content, err := readIncludeFile(node.Value)
+		if err != nil {
+			return err
+		}
+		node.SetString(content)
+		node.Tag = "!!str"
+		return nil
+	}
+	for _, child := range node.Content {
+		if err := resolveYAMLIncludes(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readIncludeFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", errors.New("Could not stat !include file " + path + ": " + err.Error())
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", errors.New("!include file " + path + " must not be group or world accessible")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.New("Could not read !include file " + path + ": " + err.Error())
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("MFASERVER_TEST_USERID", `alice"}; DROP`)
+	in := []byte(`{"UserID":"${MFASERVER_TEST_USERID}"}`)
+	out := interpolateEnv(in)
+
+	want := `{"UserID":"alice\"}; DROP"}`
+	if string(out) != want {
+		t.Fatalf("interpolateEnv() = %s, want %s", out, want)
+	}
+
+	var decoded struct {
+		UserID string
+	}
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatalf("interpolated document did not parse as valid JSON: %v", err)
+	}
+	if decoded.UserID != `alice"}; DROP` {
+		t.Fatalf("decoded UserID = %q, want %q", decoded.UserID, `alice"}; DROP`)
+	}
+}
+
+func TestInterpolateEnvUnsetLeftUntouched(t *testing.T) {
+	os.Unsetenv("MFASERVER_TEST_UNSET")
+	in := []byte(`{"UserID":"${MFASERVER_TEST_UNSET}"}`)
+	out := interpolateEnv(in)
+	if string(out) != string(in) {
+		t.Fatalf("interpolateEnv() = %s, want unchanged %s", out, in)
+	}
+}
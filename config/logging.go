@@ -0,0 +1,361 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"time"
+
+	gelf "github.com/Graylog2/go-gelf/gelf"
+	"github.com/sirupsen/logrus"
+	lSyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// Fields carries structured key/value context alongside a log message, e.g.
+// request IDs, user DNs and Vault secret paths.
+type Fields map[string]interface{}
+
+// Loggers is the structured logging interface used throughout the module.
+// The concrete implementation is backed by a logrus.Logger with one hook
+// per configured MFAServer.LogSinks entry.
+type Loggers interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+type logrusLoggers struct {
+	log *logrus.Logger
+}
+
+func (l *logrusLoggers) Debug(msg string, fields Fields) {
+	l.log.WithFields(logrus.Fields(fields)).Debug(msg)
+}
+
+func (l *logrusLoggers) Info(msg string, fields Fields) {
+	l.log.WithFields(logrus.Fields(fields)).Info(msg)
+}
+
+func (l *logrusLoggers) Warn(msg string, fields Fields) {
+	l.log.WithFields(logrus.Fields(fields)).Warn(msg)
+}
+
+func (l *logrusLoggers) Error(msg string, fields Fields) {
+	l.log.WithFields(logrus.Fields(fields)).Error(msg)
+}
+
+// discardLoggers returns a Loggers that drops all output. NewConfig uses it
+// as the default until loggerSetUp attaches the real sinks.
+func discardLoggers() Loggers {
+	l := logrus.New()
+	l.SetOutput(ioutil.Discard)
+	return &logrusLoggers{log: l}
+}
+
+// LogSinksConf configures the destinations structured log entries are
+// fanned out to. Any combination of sinks may be configured concurrently;
+// a server with none configured falls back to the legacy behaviour of
+// logging to LogFilePath, or stdout if that is unset.
+type LogSinksConf struct {
+	Stdout  *StdoutSinkConf  `json:"Stdout" yaml:"Stdout"`
+	File    *FileSinkConf    `json:"File" yaml:"File"`
+	Syslog  *SyslogSinkConf  `json:"Syslog" yaml:"Syslog"`
+	Graylog *GraylogSinkConf `json:"Graylog" yaml:"Graylog"`
+}
+
+// StdoutSinkConf writes log entries to stdout. Formatter is "json" or
+// "text" and defaults to "text".
+type StdoutSinkConf struct {
+	Formatter *string `json:"Formatter" yaml:"Formatter"`
+}
+
+// FileSinkConf writes log entries to the file at Path, creating it if
+// necessary. Formatter is "json" or "text" and defaults to "json".
+type FileSinkConf struct {
+	Path      *string `json:"Path" yaml:"Path"`
+	Formatter *string `json:"Formatter" yaml:"Formatter"`
+}
+
+// SyslogSinkConf writes log entries to syslog. Leaving Network and Address
+// unset logs to the local syslog daemon; setting them (e.g. Network "tcp",
+// Address "syslog.example.com:514") logs to a remote RFC5424 collector.
+// Tag defaults to "mfaserver".
+type SyslogSinkConf struct {
+	Network *string `json:"Network" yaml:"Network"`
+	Address *string `json:"Address" yaml:"Address"`
+	Tag     *string `json:"Tag" yaml:"Tag"`
+}
+
+// GraylogSinkConf writes log entries to a Graylog server over GELF.
+// Protocol is "udp" (the default) or "tcp". ExtraFields are merged into
+// every entry sent to this sink, e.g. to tag the environment or service.
+type GraylogSinkConf struct {
+	Host        *string                `json:"Host" yaml:"Host"`
+	Port        *int                   `json:"Port" yaml:"Port"`
+	Protocol    *string                `json:"Protocol" yaml:"Protocol"`
+	ExtraFields map[string]interface{} `json:"ExtraFields" yaml:"ExtraFields"`
+}
+
+// loggerSetUp builds a logrus.Logger for c, attaching one hook per
+// configured LogSinks entry, and honouring LogLevel (ERROR/WARNING/INFO/
+// DEBUG, mapped to the matching logrus levels and cascading as before: DEBUG
+// implies INFO and WARNING, INFO implies WARNING, and ERROR is always on).
+func loggerSetUp(c *Config) error {
+	if c.MFAServer.LogLevel == nil || !isValidLogLevel(*c.MFAServer.LogLevel) {
+		return errors.New(fmt.Sprintf("An invalid log level was provided. Accepted values are %v", validLogLevels))
+	}
+	levels := logLevelsFor(*c.MFAServer.LogLevel)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	logger.SetLevel(logrus.DebugLevel)
+
+	if c.MFAServer.LogSinks == nil {
+		w, err := defaultSinkWriter(c.MFAServer.LogFilePath)
+		if err != nil {
+			return errors.New("Could not open default log destination: " + err.Error())
+		}
+		logger.AddHook(&writerHook{w: w, formatter: &logrus.TextFormatter{}, levels: levels})
+	} else if err := addConfiguredSinks(logger, c.MFAServer.LogSinks, levels); err != nil {
+		return err
+	}
+	if len(logger.Hooks) == 0 {
+		return errors.New("LogSinks is configured but defines no sinks")
+	}
+
+	c.MFAServer.Loggers = &logrusLoggers{log: logger}
+	return nil
+}
+
+// logLevelsFor returns the logrus levels that should be active for the
+// given MFAServer LogLevel value.
+func logLevelsFor(logLevel string) []logrus.Level {
+	levels := []logrus.Level{logrus.ErrorLevel}
+	switch logLevel {
+	case "DEBUG":
+		levels = append(levels, logrus.WarnLevel, logrus.InfoLevel, logrus.DebugLevel)
+	case "INFO":
+		levels = append(levels, logrus.WarnLevel, logrus.InfoLevel)
+	case "WARNING":
+		levels = append(levels, logrus.WarnLevel)
+	}
+	return levels
+}
+
+func defaultSinkWriter(logFilePath *string) (io.Writer, error) {
+	if logFilePath == nil {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(*logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+}
+
+func addConfiguredSinks(logger *logrus.Logger, sinks *LogSinksConf, levels []logrus.Level) error {
+	if sinks.Stdout != nil {
+		logger.AddHook(&writerHook{
+			w:         os.Stdout,
+			formatter: sinkFormatter(sinks.Stdout.Formatter, &logrus.TextFormatter{}),
+			levels:    levels,
+		})
+	}
+	if sinks.File != nil {
+		if sinks.File.Path == nil {
+			return errors.New("LogSinks.File requires a Path")
+		}
+		f, err := os.OpenFile(*sinks.File.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+		if err != nil {
+			return errors.New("Could not open LogSinks.File: " + err.Error())
+		}
+		logger.AddHook(&writerHook{
+			w:         f,
+			formatter: sinkFormatter(sinks.File.Formatter, &logrus.JSONFormatter{}),
+			levels:    levels,
+		})
+	}
+	if sinks.Syslog != nil {
+		hook, err := syslogHook(sinks.Syslog, levels)
+		if err != nil {
+			return errors.New("Could not set up LogSinks.Syslog: " + err.Error())
+		}
+		logger.AddHook(hook)
+	}
+	if sinks.Graylog != nil {
+		hook, err := graylogHookFor(sinks.Graylog, levels)
+		if err != nil {
+			return errors.New("Could not set up LogSinks.Graylog: " + err.Error())
+		}
+		logger.AddHook(hook)
+	}
+	return nil
+}
+
+func sinkFormatter(name *string, def logrus.Formatter) logrus.Formatter {
+	if name == nil {
+		return def
+	}
+	switch *name {
+	case "json":
+		return &logrus.JSONFormatter{}
+	case "text":
+		return &logrus.TextFormatter{}
+	default:
+		return def
+	}
+}
+
+// writerHook fires entries formatted by formatter to w, restricted to
+// levels. It backs the stdout and file sinks.
+type writerHook struct {
+	w         io.Writer
+	formatter logrus.Formatter
+	levels    []logrus.Level
+}
+
+func (h *writerHook) Levels() []logrus.Level { return h.levels }
+
+func (h *writerHook) Fire(e *logrus.Entry) error {
+	b, err := h.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+	_, err = h.w.Write(b)
+	return err
+}
+
+// leveledHook restricts an existing logrus.Hook, which otherwise always
+// reports itself enabled for every level, to levels.
+type leveledHook struct {
+	inner  logrus.Hook
+	levels []logrus.Level
+}
+
+func (h *leveledHook) Levels() []logrus.Level     { return h.levels }
+func (h *leveledHook) Fire(e *logrus.Entry) error { return h.inner.Fire(e) }
+
+func syslogHook(conf *SyslogSinkConf, levels []logrus.Level) (logrus.Hook, error) {
+	network := ""
+	if conf.Network != nil {
+		network = *conf.Network
+	}
+	address := ""
+	if conf.Address != nil {
+		address = *conf.Address
+	}
+	tag := "mfaserver"
+	if conf.Tag != nil {
+		tag = *conf.Tag
+	}
+	hook, err := lSyslog.NewSyslogHook(network, address, syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &leveledHook{inner: hook, levels: levels}, nil
+}
+
+// gelfMessageWriter is implemented by both gelf.Writer (UDP) and
+// gelfTCPWriter, letting graylogHook build and send a gelf.Message
+// directly instead of piping pre-formatted text through an io.Writer.
+type gelfMessageWriter interface {
+	WriteMessage(m *gelf.Message) error
+}
+
+// gelfTCPWriter sends GELF messages over a persistent TCP connection.
+// go-gelf only ships a UDP gelf.Writer, so this reuses its JSON encoding
+// (gelf.Message.MarshalJSONBuf) but frames each message with the null
+// byte delimiter the GELF TCP protocol expects instead of UDP chunking.
+type gelfTCPWriter struct {
+	conn net.Conn
+}
+
+func newGelfTCPWriter(addr string) (*gelfTCPWriter, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &gelfTCPWriter{conn: conn}, nil
+}
+
+func (w *gelfTCPWriter) WriteMessage(m *gelf.Message) error {
+	buf := &bytes.Buffer{}
+	if err := m.MarshalJSONBuf(buf); err != nil {
+		return err
+	}
+	buf.WriteByte(0)
+	_, err := w.conn.Write(buf.Bytes())
+	return err
+}
+
+// graylogHook sends entries to a Graylog server as GELF messages, with the
+// logrus entry's fields (and the sink's own ExtraFields) attached as
+// first-class GELF Extra fields rather than folded into the short message.
+type graylogHook struct {
+	w      gelfMessageWriter
+	host   string
+	extra  map[string]interface{}
+	levels []logrus.Level
+}
+
+func (h *graylogHook) Levels() []logrus.Level { return h.levels }
+
+func (h *graylogHook) Fire(e *logrus.Entry) error {
+	extra := make(map[string]interface{}, len(h.extra)+len(e.Data))
+	for k, v := range h.extra {
+		extra[k] = v
+	}
+	for k, v := range e.Data {
+		extra[k] = v
+	}
+	return h.w.WriteMessage(&gelf.Message{
+		Version:  "1.1",
+		Host:     h.host,
+		Short:    e.Message,
+		TimeUnix: float64(e.Time.UnixNano()) / float64(time.Second),
+		Level:    gelfSeverity(e.Level),
+		Extra:    extra,
+	})
+}
+
+// gelfSeverity maps a logrus level to the syslog severity GELF expects.
+func gelfSeverity(l logrus.Level) int32 {
+	switch l {
+	case logrus.PanicLevel:
+		return 0
+	case logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func graylogHookFor(conf *GraylogSinkConf, levels []logrus.Level) (logrus.Hook, error) {
+	if conf.Host == nil || conf.Port == nil {
+		return nil, errors.New("LogSinks.Graylog requires a Host and Port")
+	}
+	addr := fmt.Sprintf("%s:%d", *conf.Host, *conf.Port)
+	var w gelfMessageWriter
+	var err error
+	if conf.Protocol != nil && *conf.Protocol == "tcp" {
+		w, err = newGelfTCPWriter(addr)
+	} else {
+		w, err = gelf.NewWriter(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, errors.New("Could not determine local hostname for LogSinks.Graylog: " + err.Error())
+	}
+	return &graylogHook{w: w, host: host, extra: conf.ExtraFields, levels: levels}, nil
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogLevelsFor(t *testing.T) {
+	cases := []struct {
+		logLevel string
+		want     []logrus.Level
+	}{
+		{"ERROR", []logrus.Level{logrus.ErrorLevel}},
+		{"WARNING", []logrus.Level{logrus.ErrorLevel, logrus.WarnLevel}},
+		{"INFO", []logrus.Level{logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}},
+		{"DEBUG", []logrus.Level{logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel, logrus.DebugLevel}},
+	}
+	for _, c := range cases {
+		got := logLevelsFor(c.logLevel)
+		if len(got) != len(c.want) {
+			t.Fatalf("logLevelsFor(%q) = %v, want %v", c.logLevel, got, c.want)
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Fatalf("logLevelsFor(%q) = %v, want %v", c.logLevel, got, c.want)
+			}
+		}
+	}
+}
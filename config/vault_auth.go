@@ -0,0 +1,252 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	vaultAPI "github.com/hashicorp/vault/api"
+	"github.com/jcmturner/mfaserver/vault"
+)
+
+const (
+	vaultAuthAppID      = "AppID"
+	vaultAuthAppRole    = "AppRole"
+	vaultAuthKubernetes = "Kubernetes"
+	vaultAuthToken      = "Token"
+
+	defaultKubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// AppRoleAuthConf configures the AppRole Vault authentication backend. If
+// WrappedSecretID is true, SecretID is treated as a response-wrapping token
+// that is unwrapped to obtain the real secret ID before login.
+type AppRoleAuthConf struct {
+	RoleID          *string `json:"RoleID" yaml:"RoleID"`
+	SecretID        *string `json:"SecretID" yaml:"SecretID"`
+	WrappedSecretID bool    `json:"WrappedSecretID" yaml:"WrappedSecretID"`
+}
+
+// KubernetesAuthConf configures the Kubernetes Vault authentication
+// backend. TokenPath defaults to the projected service account token path.
+type KubernetesAuthConf struct {
+	Role      *string `json:"Role" yaml:"Role"`
+	TokenPath *string `json:"TokenPath" yaml:"TokenPath"`
+}
+
+// VaultAuth authenticates against Vault using client and returns the
+// resulting login, used exactly as today to set the client's token.
+type VaultAuth interface {
+	Login(client *vaultAPI.Client) (*vault.Login, error)
+}
+
+func (c *VaultConf) authMethod() string {
+	if c.AuthMethod != nil {
+		return *c.AuthMethod
+	}
+	return vaultAuthAppID
+}
+
+// authBackend selects the VaultAuth implementation named by AuthMethod,
+// defaulting to the legacy AppID flow when it is not set.
+func (c *VaultConf) authBackend() (VaultAuth, error) {
+	switch c.authMethod() {
+	case vaultAuthAppID:
+		return &appIDAuth{vc: c}, nil
+	case vaultAuthAppRole:
+		return &appRoleAuth{conf: c.AppRole}, nil
+	case vaultAuthKubernetes:
+		return &kubernetesAuth{conf: c.Kubernetes}, nil
+	case vaultAuthToken:
+		return &tokenAuth{token: c.Token}, nil
+	default:
+		return nil, errors.New("Unsupported Vault AuthMethod: " + c.authMethod())
+	}
+}
+
+type appIDAuth struct {
+	vc *VaultConf
+}
+
+func (a *appIDAuth) Login(client *vaultAPI.Client) (*vault.Login, error) {
+	if a.vc.AppIDRead == nil || a.vc.UserID == nil {
+		return nil, errors.New("AppID authentication requires AppIDRead and UserID to be configured")
+	}
+	secret, err := client.Logical().Write("auth/app-id/login", map[string]interface{}{
+		"app_id":  *a.vc.AppIDRead,
+		"user_id": *a.vc.UserID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loginFromSecret(secret)
+}
+
+type appRoleAuth struct {
+	conf *AppRoleAuthConf
+}
+
+func (a *appRoleAuth) Login(client *vaultAPI.Client) (*vault.Login, error) {
+	if a.conf == nil || a.conf.RoleID == nil || a.conf.SecretID == nil {
+		return nil, errors.New("AppRole authentication requires RoleID and SecretID to be configured")
+	}
+	secretID := *a.conf.SecretID
+	if a.conf.WrappedSecretID {
+		unwrapped, err := client.Logical().Unwrap(secretID)
+		if err != nil {
+			return nil, errors.New("Could not unwrap AppRole SecretID: " + err.Error())
+		}
+		sid, ok := unwrapped.Data["secret_id"].(string)
+		if !ok {
+			return nil, errors.New("Unwrapped AppRole response did not contain a secret_id")
+		}
+		secretID = sid
+	}
+	secret, err := client.Logical().Write("auth/approle/login", map[string]interface{}{
+		"role_id":   *a.conf.RoleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loginFromSecret(secret)
+}
+
+type kubernetesAuth struct {
+	conf *KubernetesAuthConf
+}
+
+func (a *kubernetesAuth) Login(client *vaultAPI.Client) (*vault.Login, error) {
+	if a.conf == nil || a.conf.Role == nil {
+		return nil, errors.New("Kubernetes authentication requires Role to be configured")
+	}
+	tokenPath := defaultKubernetesTokenPath
+	if a.conf.TokenPath != nil {
+		tokenPath = *a.conf.TokenPath
+	}
+	jwt, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		return nil, errors.New("Could not read Kubernetes service account token: " + err.Error())
+	}
+	secret, err := client.Logical().Write("auth/kubernetes/login", map[string]interface{}{
+		"role": *a.conf.Role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loginFromSecret(secret)
+}
+
+type tokenAuth struct {
+	token *string
+}
+
+func (a *tokenAuth) Login(client *vaultAPI.Client) (*vault.Login, error) {
+	if a.token == nil {
+		return nil, errors.New("Token authentication requires Token to be configured")
+	}
+	client.SetToken(*a.token)
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, errors.New("Provided Vault token is not valid: " + err.Error())
+	}
+	return loginFromSecret(secret)
+}
+
+// loginFromSecret copies the auth data from a Vault API response onto a
+// vault.Login. vault.Login embeds an unexported loginResponse, so its
+// Auth/LeaseDuration/Renewable fields are reached through field promotion
+// rather than a composite literal, and the client token can only be set via
+// the promoted Auth field (there is no top-level ClientToken on vault.Login).
+func loginFromSecret(secret *vaultAPI.Secret) (*vault.Login, error) {
+	if secret == nil || secret.Auth == nil {
+		return nil, errors.New("Vault login response did not contain auth data")
+	}
+	login := &vault.Login{}
+	login.Auth.ClientToken = secret.Auth.ClientToken
+	login.LeaseDuration = secret.Auth.LeaseDuration
+	login.Renewable = secret.Auth.Renewable
+	return login, nil
+}
+
+// authenticateVault builds a Vault client from the configured AuthMethod,
+// logs in, and starts a background lifetime watcher to keep the resulting
+// token renewed for as long as the server runs.
+func (c *Config) authenticateVault() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	client, err := vaultAPI.NewClient(c.Vault.VaultConfig)
+	if err != nil {
+		return errors.New("Could not create Vault client: " + err.Error())
+	}
+	backend, err := c.Vault.authBackend()
+	if err != nil {
+		return err
+	}
+	login, err := backend.Login(client)
+	if err != nil {
+		return errors.New("Vault authentication failed: " + err.Error())
+	}
+	client.SetToken(login.Auth.ClientToken)
+	c.Vault.VaultClient = client
+	c.Vault.VaultLogin = login
+	if login.Renewable {
+		stop := make(chan struct{})
+		c.Vault.watchStop = stop
+		go c.watchVaultTokenLifetime(client, login, stop)
+	}
+	return nil
+}
+
+// stopVaultWatch signals any in-flight watchVaultTokenLifetime goroutine
+// started against this Config's Vault client to exit without
+// re-authenticating. Callers must invoke this before replacing c.Vault out
+// from under it (e.g. Reload), otherwise a stale watcher can re-authenticate
+// after the fact and clobber the replacement VaultClient/VaultLogin.
+func (c *Config) stopVaultWatch() {
+	if c.Vault.watchStop != nil {
+		close(c.Vault.watchStop)
+		c.Vault.watchStop = nil
+	}
+}
+
+// watchVaultTokenLifetime keeps login's token renewed via a
+// vaultAPI.LifetimeWatcher, logging renewal failures and re-authenticating
+// from scratch (covering the ErrPermissionDenied case) once the watcher
+// gives up. It exits without re-authenticating as soon as stop is closed,
+// so a Reload can retire it before swapping in a new Vault client.
+func (c *Config) watchVaultTokenLifetime(client *vaultAPI.Client, login *vault.Login, stop <-chan struct{}) {
+	watcher, err := client.NewLifetimeWatcher(&vaultAPI.LifetimeWatcherInput{
+		Secret: &vaultAPI.Secret{
+			Auth: &vaultAPI.SecretAuth{
+				ClientToken:   login.Auth.ClientToken,
+				LeaseDuration: login.LeaseDuration,
+				Renewable:     login.Renewable,
+			},
+		},
+	})
+	if err != nil {
+		c.MFAServer.Loggers.Warn("Could not start Vault token lifetime watcher", Fields{"error": err.Error()})
+		return
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case err := <-watcher.DoneCh():
+			if err != nil {
+				c.MFAServer.Loggers.Warn("Vault token renewal stopped", Fields{"error": err.Error()})
+			}
+			if err := c.authenticateVault(); err != nil {
+				c.MFAServer.Loggers.Error("Vault re-authentication failed", Fields{"error": err.Error()})
+			}
+			return
+		case renewal := <-watcher.RenewCh():
+			c.MFAServer.Loggers.Debug("Vault token renewed", Fields{"leaseDuration": renewal.Secret.Auth.LeaseDuration})
+		}
+	}
+}